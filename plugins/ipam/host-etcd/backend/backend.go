@@ -0,0 +1,76 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backend declares the seam between the IPAM plugin and its
+// key/value store, and a registry that lets the netconf's "backend" field
+// pick among the implementations that have registered themselves.
+package backend
+
+import "net"
+
+// Store is the interface implemented by every IPAM key/value backend:
+// etcd, Consul, and (for tests) an in-memory fake.
+type Store interface {
+	Lock() error
+	Unlock() error
+
+	// Reserve attempts to claim ip for (id, ifname) within rangeID. It
+	// returns false, nil if the IP is already held by somebody else, so
+	// the allocator can advance to the next candidate.
+	Reserve(id, ifname string, ip net.IP, rangeID string) (bool, error)
+
+	// Bind finalizes a reservation made by Reserve once the CNI ADD for
+	// sandboxPath is known to have succeeded, so the reservation survives
+	// past its provisional TTL.
+	Bind(ip net.IP, sandboxPath string) error
+
+	// Release deletes ip's reservation, but only if id is still its owner,
+	// so a stale release from a previously killed sandbox can't delete a
+	// reservation that has since been reassigned to somebody else.
+	Release(id string, ip net.IP) error
+	ReleaseByID(id string) error
+	LastReservedIP(rangeID string) (net.IP, error)
+	Close() error
+}
+
+// NewFunc constructs a Store for networkName from rawConfig, the JSON
+// object found under the IPAM netconf's "backend" key.
+type NewFunc func(networkName string, rawConfig []byte) (Store, error)
+
+var backends = map[string]NewFunc{}
+
+// Register makes a backend constructor available under name, e.g. "etcd" or
+// "consul". Implementations call this from their package init().
+func Register(name string, fn NewFunc) {
+	backends[name] = fn
+}
+
+// New dispatches to the constructor registered under name.
+func New(name, networkName string, rawConfig []byte) (Store, error) {
+	fn, ok := backends[name]
+	if !ok {
+		return nil, &UnknownBackendError{Name: name}
+	}
+	return fn(networkName, rawConfig)
+}
+
+// UnknownBackendError is returned by New when the netconf names a backend
+// that nothing has registered, e.g. a typo or a missing build tag.
+type UnknownBackendError struct {
+	Name string
+}
+
+func (e *UnknownBackendError) Error() string {
+	return "unknown IPAM backend " + e.Name + " (forgot to import its package?)"
+}
@@ -0,0 +1,217 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package backendtest holds a conformance suite that every backend.Store
+// implementation is expected to pass, so etcd, Consul, and the in-memory
+// fake all behave identically from the allocator's point of view.
+package backendtest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-etcd/backend"
+)
+
+// LeaseExpirer is implemented by backend.Store fakes that can simulate a
+// lease or session TTL lapsing instantly, so the conformance suite can
+// verify self-healing after a crash without waiting on a real cluster's
+// clock. The live etcd and Consul backends don't implement it, so the
+// suite skips these cases when run against them.
+type LeaseExpirer interface {
+	// ExpireUnboundLeases reclaims every reservation that was never
+	// finalized with Bind, as if the lease or session backing it had
+	// just lapsed.
+	ExpireUnboundLeases()
+}
+
+// RunConformanceSuite exercises newStore() against the behaviour every
+// backend.Store implementation must provide. Call it from a backend's own
+// _test.go with a constructor for that backend.
+func RunConformanceSuite(t *testing.T, newStore func(t *testing.T) backend.Store) {
+	t.Run("ReserveThenRelease", func(t *testing.T) { testReserveThenRelease(t, newStore(t)) })
+	t.Run("DuplicateReserveFails", func(t *testing.T) { testDuplicateReserveFails(t, newStore(t)) })
+	t.Run("ReleaseByID", func(t *testing.T) { testReleaseByID(t, newStore(t)) })
+	t.Run("LastReservedIP", func(t *testing.T) { testLastReservedIP(t, newStore(t)) })
+	t.Run("UnboundReservationSelfHealsOnExpiry", func(t *testing.T) { testUnboundReservationSelfHealsOnExpiry(t, newStore(t)) })
+	t.Run("BoundReservationSurvivesExpiry", func(t *testing.T) { testBoundReservationSurvivesExpiry(t, newStore(t)) })
+	t.Run("StaleReleaseAfterReassignment", func(t *testing.T) { testStaleReleaseAfterReassignment(t, newStore(t)) })
+}
+
+func testReserveThenRelease(t *testing.T, s backend.Store) {
+	ip := net.ParseIP("192.0.2.1")
+
+	ok, err := s.Reserve("container-1", "eth0", ip, "range-a")
+	if err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if !ok {
+		t.Fatalf("Reserve: expected to claim %s", ip)
+	}
+
+	if err := s.Release("container-1", ip); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	ok, err = s.Reserve("container-2", "eth0", ip, "range-a")
+	if err != nil {
+		t.Fatalf("Reserve after Release: %v", err)
+	}
+	if !ok {
+		t.Fatalf("Reserve after Release: expected %s to be free again", ip)
+	}
+}
+
+func testDuplicateReserveFails(t *testing.T, s backend.Store) {
+	ip := net.ParseIP("192.0.2.2")
+
+	ok, err := s.Reserve("container-1", "eth0", ip, "range-a")
+	if err != nil || !ok {
+		t.Fatalf("Reserve: ok=%v err=%v", ok, err)
+	}
+
+	ok, err = s.Reserve("container-2", "eth0", ip, "range-a")
+	if err != nil {
+		t.Fatalf("Reserve (duplicate): %v", err)
+	}
+	if ok {
+		t.Fatalf("Reserve (duplicate): expected %s to already be held", ip)
+	}
+}
+
+func testReleaseByID(t *testing.T, s backend.Store) {
+	ip := net.ParseIP("192.0.2.3")
+
+	if _, err := s.Reserve("container-3", "eth0", ip, "range-a"); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := s.ReleaseByID("container-3"); err != nil {
+		t.Fatalf("ReleaseByID: %v", err)
+	}
+
+	ok, err := s.Reserve("container-4", "eth0", ip, "range-a")
+	if err != nil {
+		t.Fatalf("Reserve after ReleaseByID: %v", err)
+	}
+	if !ok {
+		t.Fatalf("Reserve after ReleaseByID: expected %s to be free again", ip)
+	}
+}
+
+func testLastReservedIP(t *testing.T, s backend.Store) {
+	ip := net.ParseIP("192.0.2.4")
+
+	if _, err := s.Reserve("container-5", "eth0", ip, "range-b"); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+
+	last, err := s.LastReservedIP("range-b")
+	if err != nil {
+		t.Fatalf("LastReservedIP: %v", err)
+	}
+	if !last.Equal(ip) {
+		t.Fatalf("LastReservedIP: got %s, want %s", last, ip)
+	}
+}
+
+// testStaleReleaseAfterReassignment reproduces a crashed sandbox whose
+// delayed DEL arrives after its IP has already been reclaimed and handed to
+// a new container: the stale Release must not be allowed to delete the new
+// owner's live reservation.
+func testStaleReleaseAfterReassignment(t *testing.T, s backend.Store) {
+	ip := net.ParseIP("192.0.2.6")
+
+	if _, err := s.Reserve("container-6", "eth0", ip, "range-c"); err != nil {
+		t.Fatalf("Reserve (container-6): %v", err)
+	}
+	// Simulate the IP being reclaimed (lease expiry / external GC) and
+	// reassigned to a different container before container-6's own DEL
+	// arrives.
+	if err := s.ReleaseByID("container-6"); err != nil {
+		t.Fatalf("ReleaseByID (container-6): %v", err)
+	}
+	ok, err := s.Reserve("container-7", "eth0", ip, "range-c")
+	if err != nil {
+		t.Fatalf("Reserve (container-7): %v", err)
+	}
+	if !ok {
+		t.Fatalf("Reserve (container-7): expected %s to be free", ip)
+	}
+
+	// A stale release naming the original, now-stale owner must be a no-op.
+	if err := s.Release("container-6", ip); err != nil {
+		t.Fatalf("stale Release (container-6): %v", err)
+	}
+
+	ok, err = s.Reserve("container-8", "eth0", ip, "range-c")
+	if err != nil {
+		t.Fatalf("Reserve (container-8): %v", err)
+	}
+	if ok {
+		t.Fatalf("stale Release from container-6 incorrectly freed %s, still held by container-7", ip)
+	}
+}
+
+// testUnboundReservationSelfHealsOnExpiry reproduces a node crashing between
+// CNI ADD and Bind: the reservation must be reclaimable once its lease or
+// session lapses, with no external GC process involved.
+func testUnboundReservationSelfHealsOnExpiry(t *testing.T, s backend.Store) {
+	expirer, ok := s.(LeaseExpirer)
+	if !ok {
+		t.Skip("backend does not support simulated lease expiry")
+	}
+
+	ip := net.ParseIP("192.0.2.8")
+	if _, err := s.Reserve("container-9", "eth0", ip, "range-d"); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+
+	expirer.ExpireUnboundLeases()
+
+	ok, err := s.Reserve("container-10", "eth0", ip, "range-d")
+	if err != nil {
+		t.Fatalf("Reserve after simulated expiry: %v", err)
+	}
+	if !ok {
+		t.Fatalf("Reserve after simulated expiry: expected %s to self-heal and become free", ip)
+	}
+}
+
+// testBoundReservationSurvivesExpiry asserts the other half of the lease
+// contract: once Bind has finalized a reservation for a live pod, it must
+// not disappear when the provisional TTL it started on would have lapsed.
+func testBoundReservationSurvivesExpiry(t *testing.T, s backend.Store) {
+	expirer, ok := s.(LeaseExpirer)
+	if !ok {
+		t.Skip("backend does not support simulated lease expiry")
+	}
+
+	ip := net.ParseIP("192.0.2.9")
+	if _, err := s.Reserve("container-11", "eth0", ip, "range-e"); err != nil {
+		t.Fatalf("Reserve: %v", err)
+	}
+	if err := s.Bind(ip, "/var/run/netns/container-11"); err != nil {
+		t.Fatalf("Bind: %v", err)
+	}
+
+	expirer.ExpireUnboundLeases()
+
+	ok, err := s.Reserve("container-12", "eth0", ip, "range-e")
+	if err != nil {
+		t.Fatalf("Reserve after simulated expiry: %v", err)
+	}
+	if ok {
+		t.Fatalf("simulated expiry incorrectly freed %s after it was Bind-ed", ip)
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package consul is a Consul-backed implementation of backend.Store. It
+// mirrors the key layout and lease semantics of the etcd backend: a
+// provisional reservation lives on a short-TTL session that Consul deletes
+// automatically if it is never renewed, and Bind detaches the key from that
+// session once the CNI ADD is known to have succeeded.
+package consul
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-etcd/backend"
+	"github.com/hashicorp/consul/api"
+)
+
+const defaultSessionTTL = 5 * 60 // seconds
+
+// Store implements the backend.Store interface
+var _ backend.Store = &Store{}
+
+type Store struct {
+	client *api.Client
+	kv     *api.KV
+	lock   *api.Lock
+
+	networkName string
+	sessionID   string
+	stopRenew   chan struct{}
+}
+
+func init() {
+	backend.Register("consul", func(networkName string, rawConfig []byte) (backend.Store, error) {
+		conf, err := ParseConfig(rawConfig)
+		if err != nil {
+			return nil, err
+		}
+		return New(networkName, conf)
+	})
+}
+
+func New(networkName string, conf *Config) (*Store, error) {
+	client, err := Dial(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := conf.SessionTTL
+	if ttl == 0 {
+		ttl = defaultSessionTTL
+	}
+	ttlString := fmt.Sprintf("%ds", ttl)
+
+	sessionID, _, err := client.Session().Create(&api.SessionEntry{
+		Name:     "cni-ipam-" + networkName,
+		TTL:      ttlString,
+		Behavior: api.SessionBehaviorDelete,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stopRenew := make(chan struct{})
+	go client.Session().RenewPeriodic(ttlString, sessionID, nil, stopRenew)
+
+	lock, err := client.LockOpts(&api.LockOptions{Key: prefix(networkName) + "lock"})
+	if err != nil {
+		close(stopRenew)
+		return nil, err
+	}
+
+	return &Store{
+		client:      client,
+		kv:          client.KV(),
+		lock:        lock,
+		networkName: networkName,
+		sessionID:   sessionID,
+		stopRenew:   stopRenew,
+	}, nil
+}
+
+// Dial builds a Consul client from the consul sub-config.
+func Dial(conf *Config) (*api.Client, error) {
+	cfg := api.DefaultConfig()
+	if conf.Address != "" {
+		cfg.Address = conf.Address
+	}
+	if conf.Scheme != "" {
+		cfg.Scheme = conf.Scheme
+	}
+	cfg.Datacenter = conf.Datacenter
+	cfg.Token = conf.Token
+	cfg.TLSConfig = api.TLSConfig{
+		CAFile:             conf.CAFile,
+		CertFile:           conf.CertFile,
+		KeyFile:            conf.KeyFile,
+		InsecureSkipVerify: conf.InsecureSkipVerify,
+	}
+
+	return api.NewClient(cfg)
+}
+
+func prefix(networkName string) string {
+	return "cni/ipam/" + networkName + "/"
+}
+
+func ipKey(networkName string, ip net.IP) string {
+	return prefix(networkName) + "ips/" + ip.String()
+}
+
+func byIDPrefix(networkName, id string) string {
+	return prefix(networkName) + "by-id/" + strings.TrimSpace(id) + "/"
+}
+
+func byIDKey(networkName, id, ifname string) string {
+	return byIDPrefix(networkName, id) + strings.TrimSpace(ifname)
+}
+
+func lastReservedKey(networkName, rangeID string) string {
+	return prefix(networkName) + "last_reserved_ip" + rangeID
+}
+
+func encodeOwner(id, ifname string) string {
+	return strings.TrimSpace(id) + "\n" + strings.TrimSpace(ifname)
+}
+
+func decodeOwner(value string) (id, ifname string) {
+	parts := strings.SplitN(value, "\n", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
+
+func (s *Store) Lock() error {
+	_, err := s.lock.Lock(nil)
+	return err
+}
+
+func (s *Store) Unlock() error {
+	return s.lock.Unlock()
+}
+
+func (s *Store) Close() error {
+	close(s.stopRenew)
+	_, err := s.client.Session().Destroy(s.sessionID, nil)
+	return err
+}
+
+func (s *Store) Reserve(id, ifname string, ip net.IP, rangeID string) (bool, error) {
+	key := ipKey(s.networkName, ip)
+	owner := encodeOwner(id, ifname)
+
+	// The check-not-exists op makes the transaction fail if the key is
+	// present at all, whether still held by this same session or already
+	// detached by Bind. The lock op then binds the key to the session, so
+	// Consul deletes it automatically if the session's TTL lapses before
+	// Bind detaches it. A plain CAS or Put with a Session field set is
+	// silently ignored by the API and never ties the key to anything.
+	ok, _, _, err := s.kv.Txn(api.KVTxnOps{
+		&api.KVTxnOp{Verb: api.KVCheckNotExists, Key: key},
+		&api.KVTxnOp{Verb: api.KVLock, Key: key, Value: []byte(owner), Session: s.sessionID},
+	}, nil)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		// Somebody else already holds this IP; let the allocator try the next one.
+		return false, nil
+	}
+
+	if _, _, err := s.kv.Acquire(&api.KVPair{
+		Key:     byIDKey(s.networkName, id, ifname),
+		Value:   []byte(ip.String()),
+		Session: s.sessionID,
+	}, nil); err != nil {
+		return false, err
+	}
+
+	if _, err := s.kv.Put(&api.KVPair{
+		Key:   lastReservedKey(s.networkName, rangeID),
+		Value: []byte(ip.String()),
+	}, nil); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Bind detaches a reservation from its provisional session now that the CNI
+// ADD for sandboxPath is known to have succeeded, so it no longer expires
+// when the session's TTL lapses.
+func (s *Store) Bind(ip net.IP, sandboxPath string) error {
+	key := ipKey(s.networkName, ip)
+
+	pair, _, err := s.kv.Get(key, nil)
+	if err != nil {
+		return err
+	}
+	if pair == nil {
+		return fmt.Errorf("Bind called for an IP that is not reserved: %s", ip)
+	}
+	id, ifname := decodeOwner(string(pair.Value))
+
+	// KV.Release detaches the key from the session that Acquire bound it
+	// to in Reserve, so it becomes permanent instead of disappearing when
+	// the session's TTL lapses.
+	if _, _, err := s.kv.Release(&api.KVPair{Key: key, Value: pair.Value, Session: s.sessionID}, nil); err != nil {
+		return err
+	}
+	if _, _, err := s.kv.Release(&api.KVPair{Key: byIDKey(s.networkName, id, ifname), Value: []byte(ip.String()), Session: s.sessionID}, nil); err != nil {
+		return err
+	}
+	_, err = s.kv.Put(&api.KVPair{Key: prefix(s.networkName) + "sandboxes/" + ip.String(), Value: []byte(sandboxPath)}, nil)
+	return err
+}
+
+// LastReservedIP returns the last reserved IP if exists
+func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
+	pair, _, err := s.kv.Get(lastReservedKey(s.networkName, rangeID), nil)
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return nil, nil
+	}
+	return net.ParseIP(string(pair.Value)), nil
+}
+
+// Release deletes ip's reservation, but only if id is still its owner, so a
+// stale release from a previously killed sandbox can't wipe an IP that has
+// since been reassigned to somebody else.
+func (s *Store) Release(id string, ip net.IP) error {
+	key := ipKey(s.networkName, ip)
+
+	pair, _, err := s.kv.Get(key, nil)
+	if err != nil {
+		return err
+	}
+	if pair == nil {
+		return nil
+	}
+	ownerID, ifname := decodeOwner(string(pair.Value))
+	if ownerID != strings.TrimSpace(id) {
+		// ip was already reassigned; this release is stale.
+		return nil
+	}
+	return s.releaseIfOwnedBy(pair, byIDKey(s.networkName, ownerID, ifname))
+}
+
+// releaseIfOwnedBy deletes ipPair only if it is still at the ModifyIndex we
+// last observed, so a stale release from a previously killed sandbox can't
+// wipe an IP that has since been reassigned, then removes its companion
+// by-id entry.
+func (s *Store) releaseIfOwnedBy(ipPair *api.KVPair, idKey string) error {
+	ok, _, err := s.kv.DeleteCAS(ipPair, nil)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// The IP no longer belongs to this owner; nothing to do.
+		return nil
+	}
+	_, err = s.kv.Delete(idKey, nil)
+	return err
+}
+
+// ReleaseByID releases every reservation indexed under id that id still
+// owns. It stops and returns the first error a Consul call reports.
+func (s *Store) ReleaseByID(id string) error {
+	pairs, _, err := s.kv.List(byIDPrefix(s.networkName, id), nil)
+	if err != nil {
+		return err
+	}
+	for _, idPair := range pairs {
+		ifname := strings.TrimPrefix(idPair.Key, byIDPrefix(s.networkName, id))
+		ip := net.ParseIP(string(idPair.Value))
+		if ip == nil {
+			continue
+		}
+
+		ipPair, _, err := s.kv.Get(ipKey(s.networkName, ip), nil)
+		if err != nil {
+			return err
+		}
+		if ipPair == nil || string(ipPair.Value) != encodeOwner(id, ifname) {
+			continue
+		}
+		if err := s.releaseIfOwnedBy(ipPair, idPair.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
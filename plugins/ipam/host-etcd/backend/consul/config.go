@@ -0,0 +1,59 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consul
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Config is the "consul" sub-object of the IPAM netconf's "backend" field.
+type Config struct {
+	Address    string `json:"address,omitempty"`
+	Scheme     string `json:"scheme,omitempty"`
+	Datacenter string `json:"datacenter,omitempty"`
+	Token      string `json:"token,omitempty"`
+
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	CAFile             string `json:"caFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+
+	// SessionTTL is how long, in seconds, a provisional reservation
+	// survives without a session renewal. Defaults to defaultSessionTTL.
+	SessionTTL int `json:"sessionTTL,omitempty"`
+}
+
+// ParseConfig unmarshals the "consul" sub-object of the netconf and expands
+// any ${VAR}/$VAR references in its string fields against the process
+// environment, mirroring etcd.ParseConfig.
+func ParseConfig(raw []byte) (*Config, error) {
+	conf := &Config{}
+	if err := json.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+	conf.expandEnv()
+	return conf, nil
+}
+
+func (c *Config) expandEnv() {
+	c.Address = os.ExpandEnv(c.Address)
+	c.Scheme = os.ExpandEnv(c.Scheme)
+	c.Datacenter = os.ExpandEnv(c.Datacenter)
+	c.Token = os.ExpandEnv(c.Token)
+	c.CertFile = os.ExpandEnv(c.CertFile)
+	c.KeyFile = os.ExpandEnv(c.KeyFile)
+	c.CAFile = os.ExpandEnv(c.CAFile)
+}
@@ -24,11 +24,8 @@ import (
 	"github.com/containernetworking/plugins/plugins/ipam/host-etcd/backend"
 	"github.com/coreos/etcd/clientv3"
 	"github.com/coreos/etcd/clientv3/concurrency"
-//	"log"
-
-//	"github.com/coreos/etcd/pkg/transport"
-
-
+	"github.com/coreos/etcd/clientv3/namespace"
+	"github.com/coreos/etcd/pkg/transport"
 )
 
 const lastIPFilePrefix = "last_reserved_ip."
@@ -39,49 +36,131 @@ var defaultDataDir = "/ipam"
 // Store is a simple etcd-backed store that creates one kv pair per IP
 // address. The value of the pair is the container ID.
 type Store struct {
-	mutex *concurrency.Mutex
-	kv    clientv3.KV
+	mutex   *concurrency.Mutex
+	kv      clientv3.KV
+	lease   clientv3.Lease
+	leaseID clientv3.LeaseID
+
+	cli             *clientv3.Client
+	cancelKeepAlive context.CancelFunc
 }
 
 // Store implements the Store interface
 var _ backend.Store = &Store{}
 
-func New(network string, endPoints []string) (*Store, error) {
-	if len(endPoints) == 0 {
-		return nil, errors.New("No available endpoints for etcd client")
-	}
-//
-//	tlsInfo := transport.TLSInfo{
-//		CertFile:      "/tmp/certs/ca.pem",
-//		KeyFile:       "/tmp/certs/ca-key.pem",
-//		TrustedCAFile: "/tmp/certs/peer-cert.pem",
-//	}
-
-//	tlsConfig, err := tlsInfo.ClientConfig()
-//	if err != nil {
-//		log.Fatal(err)
-//	}
-
-	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   endPoints,
-		DialTimeout: 5 * time.Second,
-//		TLS:         tlsConfig,
+func init() {
+	backend.Register("etcd", func(networkName string, rawConfig []byte) (backend.Store, error) {
+		conf, err := ParseConfig(rawConfig)
+		if err != nil {
+			return nil, err
+		}
+		return New(networkName, conf)
 	})
-	// defer cli.Close()
+}
 
+// New connects to the cluster described by conf and scopes every operation
+// to network's namespace under conf.EtcdPrefix (or DefaultEtcdPrefix).
+// Clusters upgraded from a version that wrote the old flat /ipam/... layout
+// must be drained or migrated before rollout: New has no way to see
+// reservations outside its namespace, so a still-live flat-layout key for an
+// IP will not stop that IP from being reserved again under the new prefix.
+func New(network string, conf *Config) (*Store, error) {
+	cli, err := Dial(conf)
 	if err != nil {
 		return nil, err
 	}
 
+	prefix := conf.EtcdPrefix
+	if prefix == "" {
+		prefix = DefaultEtcdPrefix
+	}
+	ns := prefix + "/" + network + "/"
+	// Every KV, lease, and watch the client makes from here on is
+	// transparently scoped to ns, so parallel allocations across distinct
+	// networks sharing this cluster no longer see or block each other.
+	cli.KV = namespace.NewKV(cli.KV, ns)
+	cli.Watcher = namespace.NewWatcher(cli.Watcher, ns)
+	cli.Lease = namespace.NewLease(cli.Lease, ns)
+
 	session, err := concurrency.NewSession(cli)
 	if err != nil {
 		return nil, err
 	}
 
-	mutex := concurrency.NewMutex(session, "/ipam/lock")
-	kv := clientv3.NewKV(cli)
+	mutex := concurrency.NewMutex(session, "lock")
+	kv := cli.KV
+
+	ttl := conf.LeaseTTL
+	if ttl == 0 {
+		ttl = defaultLeaseTTL
+	}
+	// Use cli.Lease, not a fresh clientv3.NewLease(cli), so the lease this
+	// Store grants and keeps alive is the namespaced one wrapped above;
+	// otherwise it would bypass ns entirely.
+	lease := cli.Lease
+	leaseResp, err := lease.Grant(context.TODO(), ttl)
+	if err != nil {
+		return nil, err
+	}
+	keepAliveCtx, cancelKeepAlive := context.WithCancel(context.Background())
+	keepAlive, err := lease.KeepAlive(keepAliveCtx, leaseResp.ID)
+	if err != nil {
+		cancelKeepAlive()
+		return nil, err
+	}
+	// Drain the channel so the client library keeps renewing the lease in
+	// the background; we don't need the individual responses. Close cancels
+	// keepAliveCtx, which stops this goroutine.
+	go func() {
+		for range keepAlive {
+		}
+	}()
+
+	return &Store{mutex, kv, lease, leaseResp.ID, cli, cancelKeepAlive}, nil
+}
+
+// Dial builds an etcd client from the etcd sub-config. It is exported so
+// auxiliary tools such as store/gc can talk to the same cluster the IPAM
+// plugin does without duplicating the TLS/auth plumbing.
+func Dial(conf *Config) (*clientv3.Client, error) {
+	if len(conf.Endpoints) == 0 {
+		return nil, errors.New("No available endpoints for etcd client")
+	}
+
+	clientConf, err := clientConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientv3.New(*clientConf)
+}
+
+// clientConfig turns the etcd sub-config into a clientv3.Config, building
+// a *tls.Config for mTLS-protected clusters (the default deployment in
+// Kubernetes) when any of the TLS fields are set.
+func clientConfig(conf *Config) (*clientv3.Config, error) {
+	cfg := &clientv3.Config{
+		Endpoints:   conf.Endpoints,
+		DialTimeout: 5 * time.Second,
+		Username:    conf.Username,
+		Password:    conf.Password,
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" || conf.TrustedCAFile != "" || conf.InsecureSkipVerify {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      conf.CertFile,
+			KeyFile:       conf.KeyFile,
+			TrustedCAFile: conf.TrustedCAFile,
+		}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.InsecureSkipVerify = conf.InsecureSkipVerify
+		cfg.TLS = tlsConfig
+	}
 
-	return &Store{mutex, kv}, nil
+	return cfg, nil
 }
 
 func (s *Store) Lock() error {
@@ -92,30 +171,117 @@ func (s *Store) Unlock() error {
 	return s.mutex.Unlock(context.TODO())
 }
 
+// Close stops renewing this Store's lease and closes the underlying etcd
+// client, so New doesn't leak the KeepAlive goroutine or its connection for
+// the life of the process.
 func (s *Store) Close() error {
-	return nil
-	// return s.Unlock()
+	s.cancelKeepAlive()
+	if err := s.lease.Close(); err != nil {
+		return err
+	}
+	return s.cli.Close()
 }
 
-func (s *Store) Reserve(id string, ip net.IP, rangeID string) (bool, error) {
+// ipKey is the primary key a reservation is stored under, relative to the
+// per-network namespace New applies to the client; its value is the encoded
+// (id, ifname) owner pair.
+func ipKey(ip net.IP) string {
+	return "ips/" + ip.String()
+}
 
-	if _, err := s.kv.Put(context.TODO(), "/ipam/ips/"+ip.String(),
-		strings.TrimSpace(id)); err != nil {
-		// TODO: txn
-		return false, nil
+// byIDPrefix is the reverse-index namespace for a single container, letting
+// ReleaseByID find its reservations without scanning every IP in the range.
+func byIDPrefix(id string) string {
+	return "by-id/" + strings.TrimSpace(id) + "/"
+}
+
+func byIDKey(id, ifname string) string {
+	return byIDPrefix(id) + strings.TrimSpace(ifname)
+}
+
+// lastReservedKey is keyed on rangeID alone because the per-network
+// namespace already scopes it to this network, allowing multiple IP ranges
+// within a single network without collision.
+func lastReservedKey(rangeID string) string {
+	return "last_reserved_ip" + rangeID
+}
+
+// encodeOwner/decodeOwner pack the (id, ifname) pair that owns a
+// reservation into the value stored at ipKey, as the id and the ifname
+// separated by a newline.
+func encodeOwner(id, ifname string) string {
+	return strings.TrimSpace(id) + "\n" + strings.TrimSpace(ifname)
+}
+
+func decodeOwner(value string) (id, ifname string) {
+	parts := strings.SplitN(value, "\n", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
 	}
+	return parts[0], ""
+}
+
+func (s *Store) Reserve(id, ifname string, ip net.IP, rangeID string) (bool, error) {
+	key := ipKey(ip)
+	lastKey := lastReservedKey(rangeID)
+	owner := encodeOwner(id, ifname)
 
-	// store the reserved ip in etcd.
-	if _, err := s.kv.Put(context.TODO(), "/ipam/last_reserved_ip"+rangeID,
-		ip.String()); err != nil {
+	// Only claim the IP if nobody holds it already. CreateRevision is 0
+	// for a key that does not currently exist, so this is a compare-and-swap
+	// that is safe even if the distributed mutex's session has expired.
+	// Both the forward key and its by-id reverse index are written in the
+	// same transaction and on the same lease, so the reservation self-expires
+	// as a unit if the CNI ADD is never finalized with Bind.
+	resp, err := s.kv.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(
+			clientv3.OpPut(key, owner, clientv3.WithLease(s.leaseID)),
+			clientv3.OpPut(byIDKey(id, ifname), ip.String(), clientv3.WithLease(s.leaseID)),
+			clientv3.OpPut(lastKey, ip.String()),
+		).
+		Commit()
+	if err != nil {
 		return false, err
 	}
+	if !resp.Succeeded {
+		// Somebody else already holds this IP; let the allocator try the next one.
+		return false, nil
+	}
 	return true, nil
 }
 
+// Bind finalizes a reservation that previously succeeded, swapping its
+// short-lived lease for a permanent one (lease 0) now that the CNI ADD is
+// known to have completed and sandboxPath is a real, live pod. Reservations
+// that are never bound stay on the fast-expiring lease and self-heal
+// without an external GC process when the node that made them crashes.
+func (s *Store) Bind(ip net.IP, sandboxPath string) error {
+	key := ipKey(ip)
+
+	resp, err := s.kv.Get(context.TODO(), key)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return errors.New("Bind called for an IP that is not reserved: " + ip.String())
+	}
+	owner := string(resp.Kvs[0].Value)
+	id, ifname := decodeOwner(owner)
+
+	_, err = s.kv.Txn(context.TODO()).
+		If(clientv3.Compare(clientv3.Value(key), "=", owner)).
+		Then(
+			clientv3.OpPut(key, owner, clientv3.WithLease(0)),
+			clientv3.OpPut(byIDKey(id, ifname), ip.String(), clientv3.WithLease(0)),
+			clientv3.OpPut("sandboxes/"+ip.String(), sandboxPath),
+		).
+		Commit()
+	return err
+}
+
 // LastReservedIP returns the last reserved IP if exists
 func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
-	resp, err := s.kv.Get(context.TODO(), "/ipam/last_reserved_ip"+rangeID)
+	resp, err := s.kv.Get(context.TODO(), lastReservedKey(rangeID))
 	if err != nil {
 		return nil, err
 	}
@@ -126,24 +292,59 @@ func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
 	return net.ParseIP(string(resp.Kvs[0].Value)), nil
 }
 
-func (s *Store) Release(ip net.IP) error {
-	_, err := s.kv.Delete(context.TODO(), "/ipam/ips/"+ip.String())
+// Release deletes ip's reservation, but only if id is still its owner, so a
+// stale release from a previously killed sandbox can't wipe an IP that has
+// since been reassigned to somebody else.
+func (s *Store) Release(id string, ip net.IP) error {
+	key := ipKey(ip)
+
+	resp, err := s.kv.Get(context.TODO(), key)
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil
+	}
+	owner := string(resp.Kvs[0].Value)
+	ownerID, ifname := decodeOwner(owner)
+	if ownerID != strings.TrimSpace(id) {
+		// ip was already reassigned; this release is stale.
+		return nil
+	}
+
+	return s.releaseIfOwnedBy(context.TODO(), key, byIDKey(ownerID, ifname), owner)
+}
+
+// releaseIfOwnedBy deletes key and its by-id reverse index only if key still
+// holds owner, so a stale release from a previously killed sandbox can't
+// wipe a reservation that has since been reassigned to somebody else.
+func (s *Store) releaseIfOwnedBy(ctx context.Context, key, idKey, owner string) error {
+	_, err := s.kv.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", owner)).
+		Then(
+			clientv3.OpDelete(key),
+			clientv3.OpDelete(idKey),
+		).
+		Commit()
 	return err
 }
 
 // N.B. This function eats errors to be tolerant and
 // release as much as possible
 func (s *Store) ReleaseByID(id string) error {
-	resp, err := s.kv.Get(context.TODO(), "/ipam/ips/", clientv3.WithPrefix())
+	resp, err := s.kv.Get(context.TODO(), byIDPrefix(id), clientv3.WithPrefix())
 	if err != nil {
 		return err
 	}
 	for _, item := range resp.Kvs {
-		if strings.TrimSpace(string(item.Value)) == strings.TrimSpace(id) {
-			_, err = s.kv.Delete(context.TODO(), strings.TrimSpace(string(item.Key)))
-			if err != nil {
-				return err
-			}
+		ifname := strings.TrimPrefix(string(item.Key), byIDPrefix(id))
+		ip := net.ParseIP(string(item.Value))
+		if ip == nil {
+			continue
+		}
+		owner := encodeOwner(id, ifname)
+		if err := s.releaseIfOwnedBy(context.TODO(), ipKey(ip), string(item.Key), owner); err != nil {
+			return err
 		}
 	}
 	return nil
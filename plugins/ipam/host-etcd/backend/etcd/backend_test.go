@@ -0,0 +1,46 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-etcd/backend"
+	"github.com/containernetworking/plugins/plugins/ipam/host-etcd/backend/backendtest"
+)
+
+// TestConformance runs the shared backend conformance suite against a real
+// etcd cluster named by CNI_TEST_ETCD_ENDPOINTS (comma-separated). It is
+// skipped when that variable isn't set, since no cluster is available in
+// ordinary unit test runs.
+func TestConformance(t *testing.T) {
+	endpoints := os.Getenv("CNI_TEST_ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("set CNI_TEST_ETCD_ENDPOINTS to run against a real etcd cluster")
+	}
+
+	backendtest.RunConformanceSuite(t, func(t *testing.T) backend.Store {
+		store, err := New("conformance", &Config{
+			Endpoints: strings.Split(endpoints, ","),
+		})
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
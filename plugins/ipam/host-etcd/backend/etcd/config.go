@@ -0,0 +1,78 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcd
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Config is the "etcd" sub-object of allocator.IPAMConfig. It is populated
+// by the CNI netconf parser and passed straight to New.
+type Config struct {
+	Endpoints []string `json:"endpoints"`
+
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	TrustedCAFile      string `json:"trustedCAFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// LeaseTTL is how long, in seconds, a reservation survives without a
+	// KeepAlive before etcd reclaims it. Defaults to defaultLeaseTTL.
+	LeaseTTL int64 `json:"leaseTTL,omitempty"`
+
+	// EtcdPrefix roots every key this backend writes, so one etcd cluster
+	// can serve many CNI networks without their key spaces colliding.
+	// Defaults to DefaultEtcdPrefix.
+	EtcdPrefix string `json:"etcdPrefix,omitempty"`
+}
+
+// defaultLeaseTTL bounds how long a crashed CNI ADD can leak an IP for
+// before etcd reclaims it.
+const defaultLeaseTTL = 5 * 60
+
+// DefaultEtcdPrefix is prepended to every network's namespace when the
+// netconf doesn't set EtcdPrefix. Exported so tools that operate on the same
+// key layout from outside a Store, such as store/gc, don't have to duplicate
+// the literal.
+const DefaultEtcdPrefix = "/cni/ipam"
+
+// ParseConfig unmarshals the "etcd" sub-object of the netconf and expands
+// any ${VAR}/$VAR references in its string fields against the process
+// environment, so secrets such as Username/Password don't have to be baked
+// into /etc/cni/net.d/*.conf.
+func ParseConfig(raw []byte) (*Config, error) {
+	conf := &Config{}
+	if err := json.Unmarshal(raw, conf); err != nil {
+		return nil, err
+	}
+	conf.expandEnv()
+	return conf, nil
+}
+
+func (c *Config) expandEnv() {
+	for i, e := range c.Endpoints {
+		c.Endpoints[i] = os.ExpandEnv(e)
+	}
+	c.CertFile = os.ExpandEnv(c.CertFile)
+	c.KeyFile = os.ExpandEnv(c.KeyFile)
+	c.TrustedCAFile = os.ExpandEnv(c.TrustedCAFile)
+	c.Username = os.ExpandEnv(c.Username)
+	c.Password = os.ExpandEnv(c.Password)
+	c.EtcdPrefix = os.ExpandEnv(c.EtcdPrefix)
+}
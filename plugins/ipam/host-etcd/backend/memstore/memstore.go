@@ -0,0 +1,148 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package memstore is an in-memory backend.Store used by the conformance
+// suite in backendtest, so it can run without a live etcd or Consul cluster.
+package memstore
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-etcd/backend"
+)
+
+// Store implements the backend.Store interface
+var _ backend.Store = &Store{}
+
+type owner struct {
+	id     string
+	ifname string
+}
+
+// reservation tracks whether a reservation is still provisional, so
+// ExpireUnboundLeases can simulate a crashed sandbox whose CNI ADD never
+// called Bind, the way a real etcd lease or Consul session TTL would.
+type reservation struct {
+	owner owner
+	bound bool
+}
+
+type Store struct {
+	mu sync.Mutex
+
+	ips          map[string]reservation
+	byID         map[owner]net.IP
+	lastReserved map[string]net.IP
+}
+
+func New() *Store {
+	return &Store{
+		ips:          map[string]reservation{},
+		byID:         map[owner]net.IP{},
+		lastReserved: map[string]net.IP{},
+	}
+}
+
+func (s *Store) Lock() error   { s.mu.Lock(); return nil }
+func (s *Store) Unlock() error { s.mu.Unlock(); return nil }
+func (s *Store) Close() error  { return nil }
+
+func (s *Store) Reserve(id, ifname string, ip net.IP, rangeID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	if _, taken := s.ips[key]; taken {
+		return false, nil
+	}
+
+	o := owner{id: id, ifname: ifname}
+	s.ips[key] = reservation{owner: o}
+	s.byID[o] = ip
+	s.lastReserved[rangeID] = ip
+	return true, nil
+}
+
+func (s *Store) Bind(ip net.IP, sandboxPath string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	r, ok := s.ips[key]
+	if !ok {
+		return fmt.Errorf("Bind called for an IP that is not reserved: %s", ip)
+	}
+	r.bound = true
+	s.ips[key] = r
+	return nil
+}
+
+func (s *Store) Release(id string, ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ip.String()
+	r, ok := s.ips[key]
+	if !ok || r.owner.id != id {
+		// Either already free, or ip was reassigned: a stale release must
+		// not touch the new owner's reservation.
+		return nil
+	}
+	delete(s.ips, key)
+	delete(s.byID, r.owner)
+	return nil
+}
+
+func (s *Store) ReleaseByID(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for o, ip := range s.byID {
+		if o.id == id {
+			delete(s.byID, o)
+			delete(s.ips, ip.String())
+		}
+	}
+	return nil
+}
+
+// ExpireUnboundLeases deletes every reservation that was never finalized
+// with Bind, simulating a real backend's lease/session TTL lapsing after
+// the node that made the reservation crashes. It lets the conformance
+// suite assert self-healing without a live cluster or a real clock.
+func (s *Store) ExpireUnboundLeases() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, r := range s.ips {
+		if r.bound {
+			continue
+		}
+		delete(s.ips, key)
+		delete(s.byID, r.owner)
+	}
+}
+
+func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ip, ok := s.lastReserved[rangeID]
+	if !ok {
+		return nil, nil
+	}
+	return ip, nil
+}
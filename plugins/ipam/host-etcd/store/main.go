@@ -0,0 +1,156 @@
+// Copyright 2015 CNI authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// store is a small operator CLI for the host-etcd IPAM store. Its only
+// subcommand today, gc, repairs the ips/ <-> by-id/ indexes of a single
+// network's namespace on clusters that were upgraded from the pre-index
+// key layout.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/containernetworking/plugins/plugins/ipam/host-etcd/backend/etcd"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/namespace"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: store <gc> [flags]")
+		os.Exit(2)
+	}
+
+	switch os.Args[1] {
+	case "gc":
+		if err := gc(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "gc:", err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown subcommand %q\n", os.Args[1])
+		os.Exit(2)
+	}
+}
+
+func gc(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to a JSON file holding the etcd sub-config (endpoints, TLS, auth, etcdPrefix)")
+	network := fs.String("network", "", "CNI network name whose namespace should be repaired")
+	dryRun := fs.Bool("dry-run", false, "report what would change without writing to etcd")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *configPath == "" {
+		return fmt.Errorf("-config is required")
+	}
+	if *network == "" {
+		return fmt.Errorf("-network is required")
+	}
+
+	raw, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		return err
+	}
+	conf, err := etcd.ParseConfig(raw)
+	if err != nil {
+		return err
+	}
+
+	cli, err := etcd.Dial(conf)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	prefix := conf.EtcdPrefix
+	if prefix == "" {
+		prefix = etcd.DefaultEtcdPrefix
+	}
+	ns := prefix + "/" + *network + "/"
+	cli.KV = namespace.NewKV(cli.KV, ns)
+
+	return reconcile(cli, *dryRun)
+}
+
+// reconcile repairs the by-id/ reverse index against the authoritative
+// ips/ forward index, within the namespace cli was configured with: it
+// creates any missing by-id entries and deletes by-id entries that no
+// longer match a live reservation. By-id entries whose value does not parse
+// as an IP are left in place.
+func reconcile(cli *clientv3.Client, dryRun bool) error {
+	ctx := context.Background()
+
+	ips, err := cli.Get(ctx, "ips/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	byID, err := cli.Get(ctx, "by-id/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+
+	wantByIDKey := map[string]string{} // by-id key -> expected ip value
+
+	for _, kv := range ips.Kvs {
+		ip := strings.TrimPrefix(string(kv.Key), "ips/")
+		parts := strings.SplitN(string(kv.Value), "\n", 2)
+		id, ifname := parts[0], ""
+		if len(parts) == 2 {
+			ifname = parts[1]
+		}
+		key := "by-id/" + id + "/" + ifname
+		wantByIDKey[key] = ip
+	}
+
+	have := map[string]string{} // by-id key -> current ip value
+	for _, kv := range byID.Kvs {
+		have[string(kv.Key)] = string(kv.Value)
+	}
+
+	for key, ip := range wantByIDKey {
+		if have[key] == ip {
+			continue
+		}
+		fmt.Printf("create %s -> %s\n", key, ip)
+		if !dryRun {
+			if _, err := cli.Put(ctx, key, ip); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, ip := range have {
+		if wantIP, ok := wantByIDKey[key]; ok && wantIP == ip {
+			continue
+		}
+		if net.ParseIP(ip) == nil {
+			continue
+		}
+		fmt.Printf("delete stray %s -> %s\n", key, ip)
+		if !dryRun {
+			if _, err := cli.Delete(ctx, key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}